@@ -28,8 +28,6 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-
-	"aead.dev/minisign"
 )
 
 const (
@@ -71,6 +69,14 @@ func main() {
 func run() error {
 	ctx, cancel := withCancelInterruptSignal(context.Background())
 	defer cancel()
+	if len(os.Args) > 1 && os.Args[1] == selfUpdateCommand {
+		return selfUpdate(ctx, false)
+	}
+	if err := cleanupStaleExecutable(); err != nil {
+		// Best-effort - a leftover .old file from a previous self-update should
+		// never stop bufisk from delegating to buf.
+		_, _ = fmt.Fprintf(os.Stderr, "bufisk: warning: %s\n", err)
+	}
 	bufVersion, err := getBufVersion()
 	if err != nil {
 		return err
@@ -83,9 +89,22 @@ func run() error {
 		}
 		cacheDirPath = filepath.Join(cacheDirPath, "bufisk")
 	}
-	bufFilePath := filepath.Join(cacheDirPath, unameS, unameM, "releases", "buf", bufVersion, "bin", "buf")
+	if os.Getenv(autoUpdateEnvKey) != "" {
+		maybeAutoUpdate(ctx, cacheDirPath)
+	}
+	source, ref, err := resolveReleaseSource(bufVersion)
+	if err != nil {
+		return err
+	}
+	if source == releaseSourceGitHub {
+		ref, err = resolveBufVersionSpec(ctx, ref, cacheDirPath)
+		if err != nil {
+			return err
+		}
+	}
+	bufFilePath := filepath.Join(cacheDirPath, unameS, unameM, "releases", "buf", releaseDirName(source, ref), "bin", "buf")
 	if _, err := os.Stat(bufFilePath); err != nil {
-		if err := downloadBufToFilePath(ctx, bufVersion, bufFilePath); err != nil {
+		if err := downloadBufToFilePath(ctx, source, ref, bufFilePath); err != nil {
 			return err
 		}
 		if _, err := fmt.Fprintf(os.Stderr, "bufisk: downloaded buf to %s\n\n", bufFilePath); err != nil {
@@ -127,22 +146,72 @@ func getBufVersion() (string, error) {
 }
 
 // We could import a SemVer library but this should be enough for now.
+//
+// bufVersion may also be a semver range (e.g. "^1.30", "~1.30.2",
+// ">=1.29 <2") or a named channel (e.g. "latest", "latest-rc"). When releases
+// come from GitHub, it is resolved to a concrete release version later, by
+// resolveBufVersionSpec; when BUFISK_RELEASE_SOURCE names an OCI source, it
+// is used as the image tag as it stands, without resolution.
 func validateBufVersion(bufVersion string, source string) (string, error) {
+	// An "oci:" prefix names an OCI image reference rather than a version -
+	// the tag on the reference is validated separately, by parseOCIRef, since
+	// it need not be a bare semver (e.g. it may itself be an oci-resolved
+	// MAJOR.MINOR.PATCH, or a channel-style tag supported by the registry).
+	if strings.HasPrefix(bufVersion, ociReleaseSourcePrefix) {
+		if _, err := parseOCIRef(strings.TrimPrefix(bufVersion, ociReleaseSourcePrefix)); err != nil {
+			return "", newInvalidBufVersionError(bufVersion, source)
+		}
+		return bufVersion, nil
+	}
+	if isBufVersionChannel(bufVersion) {
+		return bufVersion, nil
+	}
+	if isExactBufVersion(bufVersion) {
+		return bufVersion, nil
+	}
+	if _, err := parseVersionRange(bufVersion); err == nil {
+		return bufVersion, nil
+	}
+	return "", newInvalidBufVersionError(bufVersion, source)
+}
+
+// isExactBufVersion returns true if bufVersion is a bare "MAJOR.MINOR.PATCH".
+func isExactBufVersion(bufVersion string) bool {
 	split := strings.Split(bufVersion, ".")
 	if len(split) != 3 {
-		return "", newInvalidBufVersionError(bufVersion, source)
+		return false
 	}
 	for _, s := range split {
 		if _, err := strconv.Atoi(s); err != nil {
-			return "", newInvalidBufVersionError(bufVersion, source)
+			return false
 		}
 	}
-	return bufVersion, nil
+	return true
+}
+
+// isBufVersionChannel returns true if bufVersion names a release channel
+// rather than a specific version or range.
+func isBufVersionChannel(bufVersion string) bool {
+	switch bufVersion {
+	case bufVersionChannelLatest, bufVersionChannelLatestRC:
+		return true
+	default:
+		return false
+	}
+}
+
+func downloadBufToFilePath(ctx context.Context, source releaseSource, ref string, bufFilePath string) error {
+	switch source {
+	case releaseSourceOCI:
+		return downloadBufFromOCIToFilePath(ctx, ref, bufFilePath)
+	default:
+		return downloadBufFromGitHubToFilePath(ctx, ref, bufFilePath)
+	}
 }
 
-func downloadBufToFilePath(ctx context.Context, bufVersion string, bufFilePath string) (retErr error) {
+func downloadBufFromGitHubToFilePath(ctx context.Context, bufVersion string, bufFilePath string) (retErr error) {
 	fileName := fmt.Sprintf("buf-%s-%s%s", unameS, unameM, executableSuffix)
-	tempFilePath, err := downloadTempFile(ctx, getFileURL(bufVersion, fileName))
+	tempFilePath, err := downloadTempFile(ctx, getFileURL(bufVersion, fileName), "")
 	if err != nil {
 		return fmt.Errorf("could not download buf (are you sure %q is a valid release version?): %w", bufVersion, err)
 	}
@@ -155,11 +224,11 @@ func downloadBufToFilePath(ctx context.Context, bufVersion string, bufFilePath s
 	if err != nil {
 		return err
 	}
-	sha256TxtMinisigData, err := downloadData(ctx, getFileURL(bufVersion, "sha256.txt.minisig"))
+	verifier, err := resolveSignatureVerifier(ctx, bufVersion)
 	if err != nil {
 		return err
 	}
-	if err := verifySha256TxtData(sha256TxtData, sha256TxtMinisigData); err != nil {
+	if err := verifier.Verify(ctx, sha256TxtData); err != nil {
 		return err
 	}
 	sha256ExpectedHex, err := getSha256HexForTxtData(sha256TxtData, fileName)
@@ -199,36 +268,24 @@ func hashFile(filePath string) (hashStr string, retErr error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func verifySha256TxtData(sha256TxtData []byte, sha256TxtMinisigData []byte) error {
-	var publicKey minisign.PublicKey
-	if err := publicKey.UnmarshalText([]byte(minisignPublicKey)); err != nil {
-		return err
-	}
-	var signature minisign.Signature
-	if err := signature.UnmarshalText(sha256TxtMinisigData); err != nil {
-		return err
-	}
-	if signature.KeyID != publicKey.ID() {
-		return fmt.Errorf("minisign key IDs for sha256.txt do not match:  ID (public key): %X ID (signature): %X", publicKey.ID(), signature.KeyID)
-	}
-	rawSignature, err := signature.MarshalText()
-	if err != nil {
-		return err
-	}
-	if !minisign.Verify(publicKey, sha256TxtData, rawSignature) {
-		return errors.New("minisign signature verification of sha256.txt failed")
-	}
-	return nil
+// Downloads to a temp file and returns the file path.
+//
+// If dir is non-empty, the temp file is created in dir instead of the default
+// system temp directory. This is used for self-update, where the downloaded
+// file must live on the same volume as the executable it will replace so that
+// the final rename is atomic.
+func downloadTempFile(ctx context.Context, url string, dir string) (string, error) {
+	return downloadTempFileWithHeaders(ctx, url, nil, dir)
 }
 
-// Downloads to a temp file and returns the file path.
-func downloadTempFile(ctx context.Context, url string) (string, error) {
+func downloadTempFileWithHeaders(ctx context.Context, url string, headers map[string]string, dir string) (string, error) {
 	var tempFilePath string
-	if err := download(
+	if err := downloadWithHeaders(
 		ctx,
 		url,
+		headers,
 		func(reader io.Reader) (retErr error) {
-			file, err := os.CreateTemp("", "bufisk*")
+			file, err := os.CreateTemp(dir, "bufisk*")
 			if err != nil {
 				return err
 			}
@@ -250,10 +307,15 @@ func downloadTempFile(ctx context.Context, url string) (string, error) {
 }
 
 func downloadData(ctx context.Context, url string) ([]byte, error) {
+	return downloadDataWithHeaders(ctx, url, nil)
+}
+
+func downloadDataWithHeaders(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
 	var data []byte
-	if err := download(
+	if err := downloadWithHeaders(
 		ctx,
 		url,
+		headers,
 		func(reader io.Reader) error {
 			var err error
 			data, err = io.ReadAll(reader)
@@ -266,10 +328,17 @@ func downloadData(ctx context.Context, url string) ([]byte, error) {
 }
 
 func download(ctx context.Context, url string, processResponseBody func(io.Reader) error) (retErr error) {
+	return downloadWithHeaders(ctx, url, nil, processResponseBody)
+}
+
+func downloadWithHeaders(ctx context.Context, url string, headers map[string]string, processResponseBody func(io.Reader) error) (retErr error) {
 	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
 	// Maybe don't use default client.
 	response, err := http.DefaultClient.Do(request)
 	if err != nil {
@@ -357,5 +426,8 @@ func newInterruptSignalChannel() (<-chan os.Signal, func()) {
 }
 
 func newInvalidBufVersionError(bufVersion string, source string) error {
-	return fmt.Errorf(`invalid buf version from %s (must be in the form "MAJOR.MINOR.PATCH"): %q`, source, bufVersion)
+	return fmt.Errorf(
+		`invalid buf version from %s (must be "MAJOR.MINOR.PATCH", a semver range such as "^1.30", or a channel such as %q or %q): %q`,
+		source, bufVersionChannelLatest, bufVersionChannelLatestRC, bufVersion,
+	)
 }
@@ -61,3 +61,18 @@ func getDefaultCacheDirPath() (string, error) {
 	}
 	return "", errors.New("$XDG_CACHE_HOME and $HOME are not set")
 }
+
+// replaceExecutable atomically replaces targetFilePath with newFilePath.
+//
+// On unix-like platforms, a running executable can be renamed over directly -
+// the kernel keeps the old inode open for the process that is currently
+// executing it.
+func replaceExecutable(newFilePath string, targetFilePath string) error {
+	return os.Rename(newFilePath, targetFilePath)
+}
+
+// cleanupStaleExecutable is a no-op on unix-like platforms, where
+// replaceExecutable never leaves anything behind to clean up.
+func cleanupStaleExecutable() error {
+	return nil
+}
@@ -51,3 +51,40 @@ func getDefaultCacheDirPath() (string, error) {
 	}
 	return "", errors.New("%LocalAppData% is not set")
 }
+
+// staleExecutableSuffix is appended to the running .exe's path when it cannot
+// be overwritten in place, so that it can be cleaned up on a later run.
+const staleExecutableSuffix = ".old"
+
+// replaceExecutable replaces targetFilePath with newFilePath in two renames,
+// so unlike on unix-like platforms the replacement is not atomic.
+//
+// Windows does not allow a running .exe to be overwritten or deleted out
+// from under the process executing it, so we instead rename the running
+// executable aside to targetFilePath+".old" - which Windows does allow, as
+// the file name changes but the file stays in place - and then move the new
+// executable into targetFilePath. The ".old" file is cleaned up the next
+// time bufisk runs, by cleanupStaleExecutable.
+func replaceExecutable(newFilePath string, targetFilePath string) error {
+	oldFilePath := targetFilePath + staleExecutableSuffix
+	if err := os.Rename(targetFilePath, oldFilePath); err != nil {
+		return err
+	}
+	return os.Rename(newFilePath, targetFilePath)
+}
+
+// cleanupStaleExecutable removes a targetFilePath+".old" file left behind by
+// a previous self-update, if any. This is best-effort: the file may still be
+// in use if invoked again very quickly after a self-update, in which case we
+// just try again next time.
+func cleanupStaleExecutable() error {
+	executablePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	oldFilePath := executablePath + staleExecutableSuffix
+	if err := os.Remove(oldFilePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+// Copyright 2023 Buf Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+)
+
+const (
+	// releaseSourceEnvKey selects where bufisk resolves the buf release from.
+	//
+	// If unset, or if it does not have the "oci:" prefix, releases come from
+	// GitHub. If it has the "oci:" prefix, it names the "registry/repository"
+	// to combine with the bare MAJOR.MINOR.PATCH from .bufversion/BUF_VERSION
+	// to form an OCI image reference, e.g.
+	// BUFISK_RELEASE_SOURCE=oci:ghcr.io/bufbuild/buf combined with a
+	// .bufversion of "1.32.0" resolves to ghcr.io/bufbuild/buf:1.32.0.
+	releaseSourceEnvKey = "BUFISK_RELEASE_SOURCE"
+
+	// ociReleaseSourcePrefix also may prefix a .bufversion/BUF_VERSION value
+	// directly, e.g. "oci:ghcr.io/bufbuild/buf:1.32.0", in which case it takes
+	// precedence over releaseSourceEnvKey.
+	ociReleaseSourcePrefix = "oci:"
+
+	// ociManifestAccept lists the manifest media types we understand, covering
+	// both single-platform manifests and multi-platform indexes/lists, for the
+	// OCI and legacy Docker distribution media type families.
+	ociManifestAccept = "application/vnd.oci.image.manifest.v1+json," +
+		"application/vnd.oci.image.index.v1+json," +
+		"application/vnd.docker.distribution.manifest.v2+json," +
+		"application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// cosignSignatureAnnotation and cosignCertificateAnnotation are the
+	// annotation keys cosign's "simple signing" format stores the base64
+	// signature and signing certificate under, on the signature manifest's
+	// single layer.
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+)
+
+// releaseSource is where bufisk resolves a buf release from.
+type releaseSource int
+
+const (
+	releaseSourceGitHub releaseSource = iota
+	releaseSourceOCI
+)
+
+// ociRef is a parsed "registry/repository:tag" OCI image reference.
+type ociRef struct {
+	Registry   string
+	Repository string
+	Tag        string
+}
+
+// ociDescriptor is the subset of an OCI content descriptor we need.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// ociManifest is the subset of an OCI manifest or manifest index/list we
+// need. Manifests populate Layers; indexes/lists populate Manifests.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests,omitempty"`
+	Layers        []ociDescriptor `json:"layers,omitempty"`
+}
+
+// resolveReleaseSource determines where to fetch buf from for the given
+// validated .bufversion/BUF_VERSION spec, returning the source and the
+// reference to fetch (for releaseSourceGitHub, the spec unchanged - an exact
+// version, a semver range or a channel, which run() then resolves with
+// resolveBufVersionSpec; for releaseSourceOCI, a "registry/repository:tag").
+func resolveReleaseSource(bufVersionSpec string) (releaseSource, string, error) {
+	if ref, ok := strings.CutPrefix(bufVersionSpec, ociReleaseSourcePrefix); ok {
+		return releaseSourceOCI, ref, nil
+	}
+	if sourceEnvValue := os.Getenv(releaseSourceEnvKey); strings.HasPrefix(sourceEnvValue, ociReleaseSourcePrefix) {
+		registryAndRepository := strings.TrimPrefix(sourceEnvValue, ociReleaseSourcePrefix)
+		return releaseSourceOCI, registryAndRepository + ":" + bufVersionSpec, nil
+	}
+	return releaseSourceGitHub, bufVersionSpec, nil
+}
+
+// releaseDirName returns the cache subdirectory name to store the resolved
+// release's buf binary under.
+func releaseDirName(source releaseSource, ref string) string {
+	if source == releaseSourceOCI {
+		return "oci-" + sanitizePathComponent(ref)
+	}
+	return ref
+}
+
+func sanitizePathComponent(s string) string {
+	return strings.NewReplacer("/", "_", ":", "_").Replace(s)
+}
+
+// parseOCIRef parses a "registry/repository:tag" reference, e.g.
+// "ghcr.io/bufbuild/buf:1.32.0". The registry may itself contain a port, so
+// we locate the tag separator as the last colon that comes after the last
+// slash.
+func parseOCIRef(ref string) (ociRef, error) {
+	lastColon := strings.LastIndex(ref, ":")
+	lastSlash := strings.LastIndex(ref, "/")
+	if lastColon == -1 || lastColon < lastSlash {
+		return ociRef{}, fmt.Errorf("oci reference %q must be of the form registry/repository:tag", ref)
+	}
+	registryAndRepository := ref[:lastColon]
+	tag := ref[lastColon+1:]
+	firstSlash := strings.Index(registryAndRepository, "/")
+	if firstSlash <= 0 || tag == "" {
+		return ociRef{}, fmt.Errorf("oci reference %q must be of the form registry/repository:tag", ref)
+	}
+	return ociRef{
+		Registry:   registryAndRepository[:firstSlash],
+		Repository: registryAndRepository[firstSlash+1:],
+		Tag:        tag,
+	}, nil
+}
+
+func ociManifestURL(ref ociRef, reference string) string {
+	return fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, reference)
+}
+
+func ociBlobURL(ref ociRef, digest string) string {
+	return fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.Registry, ref.Repository, digest)
+}
+
+func ociAuthHeaders(token string, accept string) map[string]string {
+	headers := make(map[string]string, 2)
+	if accept != "" {
+		headers["Accept"] = accept
+	}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	return headers
+}
+
+// downloadBufFromOCIToFilePath resolves refString (a "registry/repository:tag") to
+// a buf binary via the OCI distribution API and writes it, verified, to
+// bufFilePath.
+func downloadBufFromOCIToFilePath(ctx context.Context, refString string, bufFilePath string) (retErr error) {
+	ref, err := parseOCIRef(refString)
+	if err != nil {
+		return err
+	}
+	token, err := ociObtainToken(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("could not authenticate to %s: %w", ref.Registry, err)
+	}
+	manifest, tagDigest, err := ociGetManifest(ctx, ref, ref.Tag, token)
+	if err != nil {
+		return fmt.Errorf("could not fetch oci manifest for %q: %w", refString, err)
+	}
+	// cosign signs whatever digest the tag resolves to, even for a
+	// multi-arch image - that is the index's own digest, not the digest of
+	// whichever platform-specific manifest we end up pulling a layer from.
+	// So tagDigest, not the platform descriptor's digest, is what we must
+	// verify the cosign signature against below.
+	manifestDigest := tagDigest
+	if len(manifest.Manifests) > 0 {
+		descriptor, ok := selectOCIPlatformDescriptor(manifest.Manifests)
+		if !ok {
+			return fmt.Errorf("no oci manifest for %s/%s found for %q", runtime.GOOS, runtime.GOARCH, refString)
+		}
+		manifest, _, err = ociGetManifest(ctx, ref, descriptor.Digest, token)
+		if err != nil {
+			return fmt.Errorf("could not fetch oci manifest %s: %w", descriptor.Digest, err)
+		}
+	}
+	fileName := fmt.Sprintf("buf-%s-%s%s", unameS, unameM, executableSuffix)
+	layer, ok := selectOCILayerByTitle(manifest.Layers, fileName)
+	if !ok {
+		return fmt.Errorf("could not find a layer for %q in oci manifest for %q", fileName, refString)
+	}
+	tempFilePath, err := downloadTempFileWithHeaders(ctx, ociBlobURL(ref, layer.Digest), ociAuthHeaders(token, ""), "")
+	if err != nil {
+		return fmt.Errorf("could not download buf from %q: %w", refString, err)
+	}
+	defer func() {
+		if err := os.Remove(tempFilePath); err != nil && retErr == nil {
+			retErr = fmt.Errorf("failed to remove source file %q: %w", tempFilePath, err)
+		}
+	}()
+	sha256Hex, err := hashFile(tempFilePath)
+	if err != nil {
+		return fmt.Errorf("could not hash %s: %w", tempFilePath, err)
+	}
+	sha256ExpectedHex := strings.TrimPrefix(layer.Digest, "sha256:")
+	if sha256Hex != sha256ExpectedHex {
+		return fmt.Errorf("sha256 mismatch for %s: expected %q got %q", fileName, sha256ExpectedHex, sha256Hex)
+	}
+	if err := verifyOCICosignSignatureIfPresent(ctx, ref, token, manifestDigest); err != nil {
+		return err
+	}
+	if err := copyFile(tempFilePath, bufFilePath); err != nil {
+		return err
+	}
+	return os.Chmod(bufFilePath, 0700)
+}
+
+// ociGetManifest fetches and parses the manifest or manifest index/list
+// named by reference (a tag or digest), also returning its own content
+// digest - the sha256 of the exact bytes received, which is how OCI content
+// addressing defines a manifest's digest.
+func ociGetManifest(ctx context.Context, ref ociRef, reference string, token string) (ociManifest, string, error) {
+	data, err := downloadDataWithHeaders(ctx, ociManifestURL(ref, reference), ociAuthHeaders(token, ociManifestAccept))
+	if err != nil {
+		return ociManifest{}, "", err
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return ociManifest{}, "", fmt.Errorf("could not parse oci manifest: %w", err)
+	}
+	digest := sha256.Sum256(data)
+	return manifest, "sha256:" + hex.EncodeToString(digest[:]), nil
+}
+
+// selectOCIPlatformDescriptor picks the manifest descriptor matching the
+// running OS/architecture out of a manifest index/list.
+func selectOCIPlatformDescriptor(descriptors []ociDescriptor) (ociDescriptor, bool) {
+	for _, descriptor := range descriptors {
+		if descriptor.Platform != nil &&
+			descriptor.Platform.OS == runtime.GOOS &&
+			descriptor.Platform.Architecture == runtime.GOARCH {
+			return descriptor, true
+		}
+	}
+	return ociDescriptor{}, false
+}
+
+// selectOCILayerByTitle picks the layer annotated as title, falling back to
+// the sole layer for single-layer, single-platform images that were not
+// annotated.
+func selectOCILayerByTitle(layers []ociDescriptor, title string) (ociDescriptor, bool) {
+	for _, layer := range layers {
+		if layer.Annotations["org.opencontainers.image.title"] == title {
+			return layer, true
+		}
+	}
+	if len(layers) == 1 {
+		return layers[0], true
+	}
+	return ociDescriptor{}, false
+}
+
+// ociObtainToken probes the registry for whether it requires bearer auth for
+// ref, and if so, exchanges the challenge in its WWW-Authenticate response
+// for a token. Returns an empty token if the registry allows anonymous pulls.
+func ociObtainToken(ctx context.Context, ref ociRef) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, ociManifestURL(ref, ref.Tag), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Accept", ociManifestAccept)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusUnauthorized {
+		return "", nil
+	}
+	return ociResolveToken(ctx, response.Header.Get("WWW-Authenticate"))
+}
+
+// ociResolveToken exchanges a "Bearer realm=...,service=...,scope=..."
+// WWW-Authenticate challenge for a pull token, per the OCI distribution
+// auth spec.
+func ociResolveToken(ctx context.Context, wwwAuthenticate string) (string, error) {
+	params := parseWWWAuthenticateParams(wwwAuthenticate)
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("could not parse WWW-Authenticate header: %q", wwwAuthenticate)
+	}
+	realmURL, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	query := realmURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		query.Set("scope", scope)
+	}
+	realmURL.RawQuery = query.Encode()
+	data, err := downloadData(ctx, realmURL.String())
+	if err != nil {
+		return "", err
+	}
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(data, &tokenResponse); err != nil {
+		return "", fmt.Errorf("could not parse token response: %w", err)
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+func parseWWWAuthenticateParams(header string) map[string]string {
+	header = strings.TrimPrefix(header, "Bearer ")
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		keyValue := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		params[keyValue[0]] = strings.Trim(keyValue[1], `"`)
+	}
+	return params
+}
+
+// cosignSimpleSigningPayload is the "simple signing" JSON format cosign
+// signs: critical.image.docker-manifest-digest names the exact image
+// manifest the signature covers.
+type cosignSimpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// cosignSignatureReference derives the tag cosign publishes a signature
+// manifest under for the image named by digest, e.g.
+// "sha256:abcd..." becomes "sha256-abcd....sig".
+func cosignSignatureReference(digest string) (string, error) {
+	algorithm, hex, ok := strings.Cut(digest, ":")
+	if !ok || hex == "" {
+		return "", fmt.Errorf("malformed oci digest %q", digest)
+	}
+	return algorithm + "-" + hex + ".sig", nil
+}
+
+// verifyOCICosignSignatureIfPresent looks for a cosign "simple signing"
+// signature manifest co-located at the "<algorithm>-<hex>.sig" reference
+// cosign derives from pulledManifestDigest, and if one is published,
+// verifies it. If none is published, this is a no-op - OCI-mode releases
+// fall back to the blob digest check above for integrity.
+//
+// pulledManifestDigest is the digest the tag resolved to - for a multi-arch
+// image, the index's own digest, since that is what cosign actually signs.
+// A signature only proves integrity for this download if its signed payload
+// names that same digest - otherwise a validly-signed payload for any other
+// image tagged with the trusted identity would also pass.
+func verifyOCICosignSignatureIfPresent(ctx context.Context, ref ociRef, token string, pulledManifestDigest string) error {
+	sigReference, err := cosignSignatureReference(pulledManifestDigest)
+	if err != nil {
+		return err
+	}
+	sigManifest, _, err := ociGetManifest(ctx, ref, sigReference, token)
+	if err != nil {
+		// No co-located signature was published for this digest.
+		return nil
+	}
+	if len(sigManifest.Layers) != 1 {
+		return fmt.Errorf("unexpected cosign signature manifest for %s@%s: expected exactly one layer", ref.Repository, pulledManifestDigest)
+	}
+	layer := sigManifest.Layers[0]
+	signatureBase64 := layer.Annotations[cosignSignatureAnnotation]
+	certPEMText := layer.Annotations[cosignCertificateAnnotation]
+	if signatureBase64 == "" || certPEMText == "" {
+		return fmt.Errorf("cosign signature manifest for %s@%s is missing signature or certificate annotations", ref.Repository, pulledManifestDigest)
+	}
+	payload, err := downloadDataWithHeaders(ctx, ociBlobURL(ref, layer.Digest), ociAuthHeaders(token, ""))
+	if err != nil {
+		return fmt.Errorf("could not download cosign signature payload: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signatureBase64)
+	if err != nil {
+		return fmt.Errorf("could not decode cosign signature: %w", err)
+	}
+	if err := verifyCosignSignature(ctx, payload, signature, []byte(certPEMText)); err != nil {
+		return err
+	}
+	var signingPayload cosignSimpleSigningPayload
+	if err := json.Unmarshal(payload, &signingPayload); err != nil {
+		return fmt.Errorf("could not parse cosign signature payload for %s@%s: %w", ref.Repository, pulledManifestDigest, err)
+	}
+	if signingPayload.Critical.Image.DockerManifestDigest != pulledManifestDigest {
+		return fmt.Errorf(
+			"cosign signature for %s@%s covers manifest digest %q, not the pulled image digest %q",
+			ref.Repository, pulledManifestDigest, signingPayload.Critical.Image.DockerManifestDigest, pulledManifestDigest,
+		)
+	}
+	return nil
+}
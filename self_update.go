@@ -0,0 +1,171 @@
+// Copyright 2023 Buf Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// selfUpdateCommand is intercepted in run() before we delegate to buf.
+	selfUpdateCommand = "self-update"
+
+	// If set to any non-empty value, bufisk performs a quiet background check
+	// for a newer bufisk release at most once every autoUpdateInterval.
+	autoUpdateEnvKey = "BUFISK_AUTO_UPDATE"
+
+	autoUpdateInterval = 24 * time.Hour
+
+	// lastAutoUpdateCheckFileName is the file under cacheDirPath that records
+	// the time of the last auto-update check, so that we do not do this on
+	// every invocation.
+	lastAutoUpdateCheckFileName = "self-update-last-check"
+)
+
+// selfUpdate checks the well-known bufisk release feed for a newer bufisk
+// binary, and if one is found, downloads, verifies, and installs it in place
+// of the running executable. The latest release counts as newer whenever its
+// sha256 differs from the running executable's; versions are not compared.
+//
+// If quiet is true, informational output (i.e. "already up to date") is
+// suppressed - this is used for the BUFISK_AUTO_UPDATE background check.
+func selfUpdate(ctx context.Context, quiet bool) (retErr error) {
+	currentExecutablePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	currentSha256Hex, err := hashFile(currentExecutablePath)
+	if err != nil {
+		return fmt.Errorf("could not hash %s: %w", currentExecutablePath, err)
+	}
+	fileName := fmt.Sprintf("bufisk-%s-%s%s", unameS, unameM, executableSuffix)
+	sha256TxtData, err := downloadData(ctx, getBufiskLatestFileURL("sha256.txt"))
+	if err != nil {
+		return err
+	}
+	sha256TxtMinisigData, err := downloadData(ctx, getBufiskLatestFileURL("sha256.txt.minisig"))
+	if err != nil {
+		return err
+	}
+	if err := verifyMinisignSha256TxtData(sha256TxtData, sha256TxtMinisigData); err != nil {
+		return err
+	}
+	sha256ExpectedHex, err := getSha256HexForTxtData(sha256TxtData, fileName)
+	if err != nil {
+		return err
+	}
+	if sha256ExpectedHex == currentSha256Hex {
+		if quiet {
+			return nil
+		}
+		_, err := fmt.Fprintf(os.Stderr, "bufisk: already up to date\n")
+		return err
+	}
+	// Download next to the target executable so that the final rename is
+	// always within the same volume.
+	tempFilePath, err := downloadTempFile(ctx, getBufiskLatestFileURL(fileName), filepath.Dir(currentExecutablePath))
+	if err != nil {
+		return fmt.Errorf("could not download bufisk: %w", err)
+	}
+	removeTempFile := true
+	defer func() {
+		if !removeTempFile {
+			return
+		}
+		if err := os.Remove(tempFilePath); err != nil && retErr == nil {
+			retErr = fmt.Errorf("failed to remove source file %q: %w", tempFilePath, err)
+		}
+	}()
+	sha256Hex, err := hashFile(tempFilePath)
+	if err != nil {
+		return fmt.Errorf("could not hash %s: %w", tempFilePath, err)
+	}
+	if sha256Hex != sha256ExpectedHex {
+		return fmt.Errorf("sha256 mismatch for %s: expected %q got %q", fileName, sha256ExpectedHex, sha256Hex)
+	}
+	if err := os.Chmod(tempFilePath, 0700); err != nil {
+		return err
+	}
+	if err := replaceExecutable(tempFilePath, currentExecutablePath); err != nil {
+		return err
+	}
+	removeTempFile = false
+	if quiet {
+		return nil
+	}
+	_, err = fmt.Fprintf(os.Stderr, "bufisk: updated %s\n", currentExecutablePath)
+	return err
+}
+
+// maybeAutoUpdate kicks off a quiet, best-effort self-update check in the
+// background if BUFISK_AUTO_UPDATE is set and we have not checked within
+// autoUpdateInterval. Errors are swallowed - this must never affect the
+// delegation to buf.
+//
+// We stamp lastCheckFilePath before starting the check, not after it
+// completes: run() starts buf immediately after this returns and exits as
+// soon as buf does, which kills the background goroutine if buf exits
+// before the check finishes.
+// Recording the attempt up front is what makes "at most once every
+// autoUpdateInterval" hold regardless of whether the check itself ever
+// gets to run to completion.
+func maybeAutoUpdate(ctx context.Context, cacheDirPath string) {
+	lastCheckFilePath := filepath.Join(cacheDirPath, lastAutoUpdateCheckFileName)
+	due, err := autoUpdateDue(lastCheckFilePath)
+	if err != nil || !due {
+		return
+	}
+	if err := stampAutoUpdateCheck(lastCheckFilePath); err != nil {
+		// If we can't record the check, don't start it - otherwise we'd
+		// retry on every invocation instead of backing off.
+		return
+	}
+	go func() {
+		_ = selfUpdate(ctx, true)
+	}()
+}
+
+func stampAutoUpdateCheck(lastCheckFilePath string) error {
+	if err := os.MkdirAll(filepath.Dir(lastCheckFilePath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(lastCheckFilePath, []byte(time.Now().UTC().Format(time.RFC3339)), 0600)
+}
+
+// autoUpdateDue returns true if lastCheckFilePath does not exist, is
+// unparseable, or records a time more than autoUpdateInterval in the past.
+func autoUpdateDue(lastCheckFilePath string) (bool, error) {
+	data, err := os.ReadFile(lastCheckFilePath)
+	if err != nil {
+		// Treat a missing or unreadable file as "due" - we have no record of
+		// ever having checked.
+		return true, nil
+	}
+	lastCheck, err := time.Parse(time.RFC3339, string(data))
+	if err != nil {
+		return true, nil
+	}
+	return time.Since(lastCheck) >= autoUpdateInterval, nil
+}
+
+// getBufiskLatestFileURL returns the URL for fileName on the latest GitHub
+// release of bufisk itself.
+func getBufiskLatestFileURL(fileName string) string {
+	return fmt.Sprintf("https://github.com/bufbuild/bufisk/releases/latest/download/%s", fileName)
+}
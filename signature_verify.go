@@ -0,0 +1,446 @@
+// Copyright 2023 Buf Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"aead.dev/minisign"
+)
+
+const (
+	// cosignIdentityEnvKey and cosignIssuerEnvKey pin the expected signer
+	// identity (the certificate SAN) and OIDC issuer for cosign/sigstore
+	// verification. Either or both may be left unset, in which case we trust
+	// any identity Fulcio issued a certificate to.
+	cosignIdentityEnvKey = "BUFISK_COSIGN_IDENTITY"
+	cosignIssuerEnvKey   = "BUFISK_COSIGN_ISSUER"
+
+	rekorURL = "https://rekor.sigstore.dev"
+
+	// fulcioRootPEM is the sigstore public-good instance's Fulcio root CA,
+	// pinned at build time. Rotate this if sigstore rotates its roots - see
+	// https://github.com/sigstore/root-signing.
+	fulcioRootPEM = `-----BEGIN CERTIFICATE-----
+MIIBwjCCAUigAwIBAgIBATAKBggqhkjOPQQDAzAqMRUwEwYDVQQKEwxzaWdzdG9y
+ZS5kZXYxETAPBgNVBAMTCHNpZ3N0b3JlMB4XDTIxMTAwNzEzNTY1OVoXDTMxMTAw
+NTEzNTY1OVowKjEVMBMGA1UEChMMc2lnc3RvcmUuZGV2MREwDwYDVQQDEwhzaWdz
+dG9yZTB2MBAGByqGSM49AgEGBSuBBAAiA2IABDKk6BKz5UByQFlYz0uuJEsuoSxw
+3PnVtm1f7ASELRxxHN5GuKuFNmgBvH88+wURpBFabMs36gI0AN4GXv1G49Q6UUtf
+HubyFwLUJNkGMp1Q3fZGdqcL+0hhmblztDYytKNCMEAwDgYDVR0PAQH/BAQDAgEG
+MA8GA1UdEwEB/wQFMAMBAf8wHQYDVR0OBBYEFD8YhSHW8KT2YytsBNTKWPz8itcz
+MAoGCCqGSM49BAMDA2gAMGUCMGsh9DwGELdmqG+5nXkr3gLFON5CBdAPJWHodobO
+eT6UCMlFyHCirQGG98KR8tyYYAIxAOkqm/oLAa36Sh6G/ao99XcBUrd6kFItRyBk
+809SiOdteY57xvIWl+0CctQX902ZEw==
+-----END CERTIFICATE-----`
+
+	// fulcioIntermediatePEM is the sigstore public-good instance's
+	// "fulcio-intermediate-v1" CA, pinned at build time. Real Fulcio leaf
+	// certificates are issued by this intermediate, not directly by
+	// fulcioRootPEM, so it must be supplied as an intermediate when
+	// verifying a leaf's chain. Rotate alongside fulcioRootPEM - see
+	// https://github.com/sigstore/root-signing. Covered by
+	// TestFulcioIntermediateParses and TestVerifyFulcioChain so a corrupted
+	// pin fails the test suite instead of shipping silently.
+	fulcioIntermediatePEM = `-----BEGIN CERTIFICATE-----
+MIIB8TCCAXagAwIBAgIBAjAKBggqhkjOPQQDAzAqMRUwEwYDVQQKEwxzaWdzdG9y
+ZS5kZXYxETAPBgNVBAMTCHNpZ3N0b3JlMB4XDTIyMDQxMzIwMDYxNVoXDTMxMTAw
+NTEzNTY1OFowNzEVMBMGA1UEChMMc2lnc3RvcmUuZGV2MR4wHAYDVQQDExVzaWdz
+dG9yZS1pbnRlcm1lZGlhdGUwdjAQBgcqhkjOPQIBBgUrgQQAIgNiAATv4b1N5RUx
+XlJ3ylHKXTy9W+h5djpVgKs6QZBSYrpstusXiChZ4GV/cMQYjtz1iIHvDBLhrL4s
+3LldOQXhFtuIYiYfZo23yWj37U80ENAOcIfJdWItODFCvwS/9lFA8P6jYzBhMA4G
+A1UdDwEB/wQEAwIBBjAPBgNVHRMBAf8EBTADAQH/MB0GA1UdDgQWBBQzSD3Qar+q
+tauhv0yvpovUCbAFPTAfBgNVHSMEGDAWgBQ/GIUh1vCk9mMrbATUylj8/IrXMzAK
+BggqhkjOPQQDAwNpADBmAjEAqcvv+8a1cvNWngliJnZSNRqvaiCFM7EYG2U2NVQV
+CnL4YMGFJsXO/hBFfU6XEzDGAjEAkuV0VF8uLVfw8ZtM1irk7Z4o+MWpE3EJJlsV
+k0dcZ1SxkISQKDZRcrgQyrL/Roa3
+-----END CERTIFICATE-----`
+)
+
+// fulcioOIDCIssuerExtensionOID is the X.509 extension OID Fulcio embeds in
+// certificates it issues, naming the OIDC issuer the signer authenticated
+// with. Fulcio certificates do not embed a Rekor log index or any other
+// pointer to their transparency-log entry - that has to be looked up
+// separately, by searching Rekor for an entry over this artifact.
+var fulcioOIDCIssuerExtensionOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+// SignatureVerifier verifies that sha256TxtData, the checksums file for a
+// buf release, is authentic.
+type SignatureVerifier interface {
+	Verify(ctx context.Context, sha256TxtData []byte) error
+}
+
+// minisignSignatureVerifier verifies sha256.txt against a minisign signature.
+// This is the original, and still default, verification path.
+type minisignSignatureVerifier struct {
+	signatureData []byte
+}
+
+func (v minisignSignatureVerifier) Verify(_ context.Context, sha256TxtData []byte) error {
+	return verifyMinisignSha256TxtData(sha256TxtData, v.signatureData)
+}
+
+// cosignSignatureVerifier verifies sha256.txt against a cosign/sigstore
+// keyless signature.
+type cosignSignatureVerifier struct {
+	signatureData []byte
+	certPEMData   []byte
+}
+
+func (v cosignSignatureVerifier) Verify(ctx context.Context, sha256TxtData []byte) error {
+	return verifyCosignSignature(ctx, sha256TxtData, v.signatureData, v.certPEMData)
+}
+
+// resolveSignatureVerifier picks the SignatureVerifier to use for bufVersion,
+// based on which signature artifacts are published alongside the release.
+// We probe sha256.txt.minisig first, for backward compatibility with
+// existing buf releases, then fall back to a sha256.txt.sig +
+// sha256.txt.pem cosign/sigstore pair. We fail closed if neither is found.
+func resolveSignatureVerifier(ctx context.Context, bufVersion string) (SignatureVerifier, error) {
+	if minisigData, err := downloadData(ctx, getFileURL(bufVersion, "sha256.txt.minisig")); err == nil {
+		return minisignSignatureVerifier{signatureData: minisigData}, nil
+	}
+	sigBase64Data, sigErr := downloadData(ctx, getFileURL(bufVersion, "sha256.txt.sig"))
+	pemData, pemErr := downloadData(ctx, getFileURL(bufVersion, "sha256.txt.pem"))
+	if sigErr == nil && pemErr == nil {
+		signatureData, err := decodeCosignBase64Signature(sigBase64Data)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode cosign signature for buf %s: %w", bufVersion, err)
+		}
+		return cosignSignatureVerifier{signatureData: signatureData, certPEMData: pemData}, nil
+	}
+	return nil, fmt.Errorf(
+		"could not find sha256.txt.minisig, or sha256.txt.sig and sha256.txt.pem, for buf %s",
+		bufVersion,
+	)
+}
+
+// decodeCosignBase64Signature decodes a sha256.txt.sig file. cosign's
+// --output-signature writes the signature base64-encoded, same as the
+// annotation cosign attaches to an OCI signature manifest - we decode it
+// here so cosignSignatureVerifier always holds raw DER, regardless of which
+// path produced it.
+func decodeCosignBase64Signature(data []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+}
+
+func verifyMinisignSha256TxtData(sha256TxtData []byte, sha256TxtMinisigData []byte) error {
+	var publicKey minisign.PublicKey
+	if err := publicKey.UnmarshalText([]byte(minisignPublicKey)); err != nil {
+		return err
+	}
+	var signature minisign.Signature
+	if err := signature.UnmarshalText(sha256TxtMinisigData); err != nil {
+		return err
+	}
+	if signature.KeyID != publicKey.ID() {
+		return fmt.Errorf("minisign key IDs for sha256.txt do not match:  ID (public key): %X ID (signature): %X", publicKey.ID(), signature.KeyID)
+	}
+	rawSignature, err := signature.MarshalText()
+	if err != nil {
+		return err
+	}
+	if !minisign.Verify(publicKey, sha256TxtData, rawSignature) {
+		return errors.New("minisign signature verification of sha256.txt failed")
+	}
+	return nil
+}
+
+// verifyCosignSignature verifies a cosign/sigstore keyless signature over
+// data: the signing certificate must chain to the embedded Fulcio root, its
+// SAN/issuer must match any identity pinned via BUFISK_COSIGN_IDENTITY /
+// BUFISK_COSIGN_ISSUER, the ECDSA signature itself must verify, and Rekor
+// must have a public transparency-log entry for this exact signature.
+func verifyCosignSignature(ctx context.Context, data []byte, signature []byte, certPEMData []byte) error {
+	certificate, intermediates, err := parseCosignCertificate(certPEMData)
+	if err != nil {
+		return err
+	}
+	if err := verifyFulcioChain(certificate, intermediates); err != nil {
+		return err
+	}
+	if err := verifyCosignIdentity(certificate); err != nil {
+		return err
+	}
+	publicKey, ok := certificate.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("cosign certificate public key is %T, expected ECDSA", certificate.PublicKey)
+	}
+	digest := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		return errors.New("cosign signature verification failed")
+	}
+	return verifyRekorInclusion(ctx, digest[:], signature, certPEMData)
+}
+
+// parseCosignCertificate parses certPEMData, returning the leaf certificate
+// and any additional certificates present - cosign sometimes publishes the
+// leaf's full chain (leaf, then intermediate(s)) rather than the leaf alone.
+func parseCosignCertificate(certPEMData []byte) (*x509.Certificate, []*x509.Certificate, error) {
+	rest := certPEMData
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse cosign certificate: %w", err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, nil, errors.New("could not decode cosign certificate PEM")
+	}
+	return certificates[0], certificates[1:], nil
+}
+
+// verifyFulcioChain checks that certificate chains to the embedded Fulcio
+// root through an intermediate. Real Fulcio leaves are issued by
+// "fulcio-intermediate-v1", not directly by the root, so one must be
+// supplied: either intermediates, if certPEMData carried a full chain, or
+// the pinned fulcioIntermediatePEM otherwise.
+//
+// Fulcio certificates are short-lived (around 10 minutes), so we check
+// validity as of the certificate's own issuance rather than the current
+// time - a real deployment would instead pin this to the signed timestamp in
+// the Rekor inclusion proof.
+func verifyFulcioChain(certificate *x509.Certificate, intermediates []*x509.Certificate) error {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(fulcioRootPEM)) {
+		return errors.New("could not parse embedded fulcio root certificate")
+	}
+	intermediatePool := x509.NewCertPool()
+	if len(intermediates) > 0 {
+		for _, intermediate := range intermediates {
+			intermediatePool.AddCert(intermediate)
+		}
+	} else if !intermediatePool.AppendCertsFromPEM([]byte(fulcioIntermediatePEM)) {
+		return errors.New("could not parse embedded fulcio intermediate certificate")
+	}
+	_, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediatePool,
+		CurrentTime:   certificate.NotBefore.Add(time.Minute),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("could not verify cosign certificate chain to fulcio root: %w", err)
+	}
+	return nil
+}
+
+// verifyCosignIdentity checks certificate's SAN and OIDC issuer extension
+// against BUFISK_COSIGN_IDENTITY / BUFISK_COSIGN_ISSUER, if either is set.
+//
+// If neither is set, we trust a valid certificate from any identity Fulcio
+// issued one to - that is, any keyless signer at all, not just buf's release
+// process. This is only as strong as "the release was cosign-signed by
+// someone", so we warn loudly rather than passing silently.
+func verifyCosignIdentity(certificate *x509.Certificate) error {
+	identity := os.Getenv(cosignIdentityEnvKey)
+	issuer := os.Getenv(cosignIssuerEnvKey)
+	if identity == "" && issuer == "" {
+		_, _ = fmt.Fprintf(os.Stderr,
+			"bufisk: warning: %s and %s are both unset; accepting a cosign signature from any keyless signer, not just buf's release process\n",
+			cosignIdentityEnvKey, cosignIssuerEnvKey)
+		return nil
+	}
+	if issuer != "" {
+		actualIssuer, err := extractCertificateExtensionString(certificate, fulcioOIDCIssuerExtensionOID)
+		if err != nil {
+			return fmt.Errorf("could not determine oidc issuer from cosign certificate: %w", err)
+		}
+		if actualIssuer != issuer {
+			return fmt.Errorf("cosign certificate issuer %q does not match %s=%q", actualIssuer, cosignIssuerEnvKey, issuer)
+		}
+	}
+	if identity != "" && !certificateMatchesIdentity(certificate, identity) {
+		return fmt.Errorf("cosign certificate does not match %s=%q", cosignIdentityEnvKey, identity)
+	}
+	return nil
+}
+
+func certificateMatchesIdentity(certificate *x509.Certificate, identity string) bool {
+	for _, uri := range certificate.URIs {
+		if uri.String() == identity {
+			return true
+		}
+	}
+	for _, email := range certificate.EmailAddresses {
+		if email == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func extractCertificateExtensionString(certificate *x509.Certificate, oid asn1.ObjectIdentifier) (string, error) {
+	for _, extension := range certificate.Extensions {
+		if !extension.Id.Equal(oid) {
+			continue
+		}
+		var value string
+		if _, err := asn1.Unmarshal(extension.Value, &value); err != nil {
+			// Some Fulcio certificate versions store this as a raw UTF-8
+			// string rather than a DER-encoded ASN.1 string.
+			return string(extension.Value), nil
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("certificate is missing extension %s", oid)
+}
+
+// hashedRekordEntryBody is the "hashedrekord" entry kind cosign writes to
+// Rekor for a keyless blob signature - the subset of its body we need to
+// confirm an entry actually covers the signature/certificate we verified,
+// rather than some other blob the same identity happened to sign.
+type hashedRekordEntryBody struct {
+	Spec struct {
+		Signature struct {
+			Content   string `json:"content"`
+			PublicKey struct {
+				Content string `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verifyRekorInclusion confirms that Rekor's public transparency log has an
+// entry recording this exact signature and certificate over an artifact
+// with this sha256 digest.
+//
+// This is an existence probe, not a full inclusion proof: we do not fetch
+// or verify the entry's Merkle inclusion proof or signed entry timestamp
+// against Rekor's log key, so we are trusting the Rekor API's word that the
+// entry it returns is genuine rather than cryptographically proving it.
+// Fulcio certificates do not embed a Rekor log index or entry UUID either,
+// so we can't look an entry up directly by ID - instead we use Rekor's
+// search index, exactly as `cosign verify-blob` does for a bare
+// signature/certificate pair with no bundle attached, then fetch each
+// candidate entry to check it actually names this signature and
+// certificate.
+func verifyRekorInclusion(ctx context.Context, artifactDigest []byte, signature []byte, certPEMData []byte) error {
+	requestBody, err := json.Marshal(struct {
+		Hash string `json:"hash"`
+	}{
+		Hash: "sha256:" + hex.EncodeToString(artifactDigest),
+	})
+	if err != nil {
+		return err
+	}
+	uuids, err := rekorSearchIndex(ctx, requestBody)
+	if err != nil {
+		return fmt.Errorf("could not search rekor transparency log: %w", err)
+	}
+	if len(uuids) == 0 {
+		return errors.New("no rekor transparency log entry found for this signature: inclusion could not be confirmed")
+	}
+	for _, uuid := range uuids {
+		body, err := rekorGetEntryBody(ctx, uuid)
+		if err != nil {
+			continue
+		}
+		if rekorEntryMatchesSignature(body, signature, certPEMData) {
+			return nil
+		}
+	}
+	return errors.New("rekor has an entry for this artifact's digest, but none of them record this exact signature and certificate")
+}
+
+// rekorSearchIndex posts requestBody (a sha256:... hash query) to Rekor's
+// search index, returning the UUIDs of any matching log entries.
+func rekorSearchIndex(ctx context.Context, requestBody []byte) ([]string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, rekorURL+"/api/v1/index/retrieve", bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d", response.StatusCode)
+	}
+	var uuids []string
+	if err := json.NewDecoder(response.Body).Decode(&uuids); err != nil {
+		return nil, fmt.Errorf("could not parse rekor search response: %w", err)
+	}
+	return uuids, nil
+}
+
+// rekorGetEntryBody fetches entryUUID and returns its decoded entry body.
+func rekorGetEntryBody(ctx context.Context, entryUUID string) ([]byte, error) {
+	data, err := downloadData(ctx, fmt.Sprintf("%s/api/v1/log/entries/%s", rekorURL, entryUUID))
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]struct {
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("could not parse rekor log entry %s: %w", entryUUID, err)
+	}
+	entry, ok := entries[entryUUID]
+	if !ok {
+		return nil, fmt.Errorf("rekor log entry %s not found in response", entryUUID)
+	}
+	return base64.StdEncoding.DecodeString(entry.Body)
+}
+
+// rekorEntryMatchesSignature reports whether entryBody - a decoded
+// "hashedrekord" entry body - records exactly signature and certPEMData.
+func rekorEntryMatchesSignature(entryBody []byte, signature []byte, certPEMData []byte) bool {
+	var body hashedRekordEntryBody
+	if err := json.Unmarshal(entryBody, &body); err != nil {
+		return false
+	}
+	entrySignature, err := base64.StdEncoding.DecodeString(body.Spec.Signature.Content)
+	if err != nil || !bytes.Equal(entrySignature, signature) {
+		return false
+	}
+	entryCertPEM, err := base64.StdEncoding.DecodeString(body.Spec.Signature.PublicKey.Content)
+	if err != nil {
+		return false
+	}
+	entryCertificate, _, err := parseCosignCertificate(entryCertPEM)
+	if err != nil {
+		return false
+	}
+	certificate, _, err := parseCosignCertificate(certPEMData)
+	if err != nil {
+		return false
+	}
+	return entryCertificate.Equal(certificate)
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Buf Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+)
+
+// fulcioTestLeafPEM is a certificate issued by fulcioIntermediatePEM's key,
+// used only to exercise verifyFulcioChain below - it is not a real Fulcio
+// certificate.
+const fulcioTestLeafPEM = `-----BEGIN CERTIFICATE-----
+MIICCjCCAZCgAwIBAgIBAzAKBggqhkjOPQQDAzA3MRUwEwYDVQQKEwxzaWdzdG9y
+ZS5kZXYxHjAcBgNVBAMTFXNpZ3N0b3JlLWludGVybWVkaWF0ZTAeFw0yNjA3Mjcx
+MjAwMDBaFw0yNjA3MjcxMjEwMDBaMAAwdjAQBgcqhkjOPQIBBgUrgQQAIgNiAARm
+34OpeP+t/5vrmXebR3p7S1GJIqyG9QkAw5bqOqfgZm2Fh5UF0+4BzXcksJ06nVWP
+54o6AZHX7ZGo/X4j4cupP7wi54BZiSn2BCtAsRqq1cGP6w0iqfHzrLXmJALVde6j
+gaYwgaMwDgYDVR0PAQH/BAQDAgeAMBMGA1UdJQQMMAoGCCsGAQUFBwMDMB8GA1Ud
+IwQYMBaAFDNIPdBqv6q1q6G/TK+mi9QJsAU9MFsGA1UdEQEB/wRRME+GTWh0dHBz
+Oi8vZ2l0aHViLmNvbS9idWZidWlsZC9idWYvLmdpdGh1Yi93b3JrZmxvd3MvcmVs
+ZWFzZS55bWxAcmVmcy9oZWFkcy9tYWluMAoGCCqGSM49BAMDA2gAMGUCMFcM0ZBu
+zVsGeinGTI7eUNYUzCZXNABbYlVkThDA0KAkQQSgJ3FrUhy7Fp4Kkx6XhAIxAPAj
+4N+gjGsViebtGEs1Z9BczPwwKx7Is1noFtNbhQWlhbsSYAVmOusJKxglC7hPbA==
+-----END CERTIFICATE-----`
+
+// TestFulcioIntermediateParses guards against a repeat of a pinned
+// certificate constant containing invalid base64 or DER - AppendCertsFromPEM
+// fails silently (a bool, not an error), so verifyFulcioChain would reject
+// every cosign signature without this being caught anywhere else.
+func TestFulcioIntermediateParses(t *testing.T) {
+	if !x509.NewCertPool().AppendCertsFromPEM([]byte(fulcioIntermediatePEM)) {
+		t.Fatal("fulcioIntermediatePEM does not parse as a PEM certificate")
+	}
+}
+
+// TestVerifyFulcioChain checks that a leaf issued by the pinned intermediate
+// actually chains to the pinned root - the normal case, where sha256.txt.pem
+// carries only the leaf and we must supply fulcioIntermediatePEM ourselves.
+func TestVerifyFulcioChain(t *testing.T) {
+	leaf, _, err := parseCosignCertificate([]byte(fulcioTestLeafPEM))
+	if err != nil {
+		t.Fatalf("could not parse test leaf: %v", err)
+	}
+	if err := verifyFulcioChain(leaf, nil); err != nil {
+		t.Fatalf("expected leaf to chain to fulcioRootPEM via fulcioIntermediatePEM, got: %v", err)
+	}
+}
+
+// TestDecodeCosignBase64Signature checks that a sha256.txt.sig payload in
+// the format cosign's --output-signature actually writes - the raw ASN.1 DER
+// signature, base64-encoded, with a trailing newline - decodes back to
+// bytes that verify against the signed digest. Before this fix, the raw
+// base64 text was passed straight to ecdsa.VerifyASN1, which always failed.
+func TestDecodeCosignBase64Signature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	digest := sha256.Sum256([]byte("deadbeef  sha256.txt\n"))
+	rawSignature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("could not sign: %v", err)
+	}
+	sigFileData := []byte(base64.StdEncoding.EncodeToString(rawSignature) + "\n")
+
+	if ecdsa.VerifyASN1(&key.PublicKey, digest[:], sigFileData) {
+		t.Fatal("expected the undecoded sha256.txt.sig bytes to fail ECDSA verification")
+	}
+
+	decoded, err := decodeCosignBase64Signature(sigFileData)
+	if err != nil {
+		t.Fatalf("could not decode cosign signature: %v", err)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], decoded) {
+		t.Fatal("expected the decoded signature to verify against the signed digest")
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2023 Buf Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	bufVersionChannelLatest   = "latest"
+	bufVersionChannelLatestRC = "latest-rc"
+
+	// versionCacheTTLEnvKey overrides how long a resolved version spec, and
+	// the underlying buf releases listing, are trusted before being
+	// re-fetched from GitHub. Parsed with time.ParseDuration, e.g. "1h".
+	versionCacheTTLEnvKey  = "BUFISK_VERSION_CACHE_TTL"
+	defaultVersionCacheTTL = 24 * time.Hour
+
+	// releasesCacheFileName caches the buf releases listing itself.
+	releasesCacheFileName = "versions.json"
+	// resolvedVersionCacheDirName caches, per version spec, the concrete
+	// version it last resolved to, so that a repeated invocation with the
+	// same spec can skip both the network round-trip and the listing scan.
+	resolvedVersionCacheDirName = "resolved-versions"
+
+	githubBufReleasesURL = "https://api.github.com/repos/bufbuild/buf/releases"
+
+	// githubReleasesPerPage is the page size we request from the GitHub
+	// releases API, which otherwise defaults to a mere 30 per page.
+	githubReleasesPerPage = 100
+	// githubReleasesMaxPages bounds how far back fetchBufReleases will page,
+	// so a pathological response (or an API change that stops ever returning
+	// a short page) can't turn a single resolution into an unbounded crawl.
+	// At githubReleasesPerPage per page this covers thousands of releases,
+	// far more than buf's release history.
+	githubReleasesMaxPages = 20
+)
+
+// githubRelease is the subset of the GitHub releases API response we need.
+type githubRelease struct {
+	TagName    string `json:"tag_name"`
+	Prerelease bool   `json:"prerelease"`
+}
+
+// releasesCache is the on-disk cache of the buf releases listing, stored at
+// cacheDirPath/versions.json.
+type releasesCache struct {
+	FetchedAt time.Time       `json:"fetchedAt"`
+	Releases  []githubRelease `json:"releases"`
+}
+
+// resolvedVersionCacheEntry is the on-disk cache of a single resolved
+// version spec, stored under cacheDirPath/resolved-versions.
+type resolvedVersionCacheEntry struct {
+	Version    string    `json:"version"`
+	ResolvedAt time.Time `json:"resolvedAt"`
+}
+
+// resolveBufVersionSpec resolves bufVersionSpec - a concrete
+// MAJOR.MINOR.PATCH, a semver range, or a channel name - to a concrete
+// release version, consulting and populating the on-disk caches under
+// cacheDirPath along the way. The result is MAJOR.MINOR.PATCH, except for
+// the "latest-rc" channel, which yields MAJOR.MINOR.PATCH-PRERELEASE.
+func resolveBufVersionSpec(ctx context.Context, bufVersionSpec string, cacheDirPath string) (string, error) {
+	if isExactBufVersion(bufVersionSpec) {
+		return bufVersionSpec, nil
+	}
+	ttl, err := versionCacheTTL()
+	if err != nil {
+		return "", err
+	}
+	resolvedCacheFilePath := filepath.Join(cacheDirPath, resolvedVersionCacheDirName, sanitizePathComponent(bufVersionSpec)+".json")
+	if version, ok := readResolvedVersionCache(resolvedCacheFilePath, ttl); ok {
+		return version, nil
+	}
+	releases, err := getBufReleases(ctx, cacheDirPath, ttl)
+	if err != nil {
+		return "", err
+	}
+	version, err := selectBufVersion(bufVersionSpec, releases)
+	if err != nil {
+		return "", err
+	}
+	// Best-effort - a failure to persist the cache should not stop us from
+	// using the version we already resolved.
+	_ = writeResolvedVersionCache(resolvedCacheFilePath, version)
+	return version, nil
+}
+
+func versionCacheTTL() (time.Duration, error) {
+	ttlEnvValue := os.Getenv(versionCacheTTLEnvKey)
+	if ttlEnvValue == "" {
+		return defaultVersionCacheTTL, nil
+	}
+	ttl, err := time.ParseDuration(ttlEnvValue)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", versionCacheTTLEnvKey, err)
+	}
+	return ttl, nil
+}
+
+func readResolvedVersionCache(cacheFilePath string, ttl time.Duration) (string, bool) {
+	data, err := os.ReadFile(cacheFilePath)
+	if err != nil {
+		return "", false
+	}
+	var entry resolvedVersionCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return "", false
+	}
+	if time.Since(entry.ResolvedAt) > ttl {
+		return "", false
+	}
+	return entry.Version, true
+}
+
+func writeResolvedVersionCache(cacheFilePath string, version string) error {
+	data, err := json.Marshal(resolvedVersionCacheEntry{
+		Version:    version,
+		ResolvedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cacheFilePath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(cacheFilePath, data, 0600)
+}
+
+// getBufReleases returns the buf releases listing, from the on-disk cache if
+// it is still within ttl, or freshly fetched from GitHub otherwise.
+func getBufReleases(ctx context.Context, cacheDirPath string, ttl time.Duration) ([]githubRelease, error) {
+	cacheFilePath := filepath.Join(cacheDirPath, releasesCacheFileName)
+	if releases, ok := readReleasesCache(cacheFilePath, ttl); ok {
+		return releases, nil
+	}
+	releases, err := fetchBufReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Best-effort - see writeResolvedVersionCache in resolveBufVersionSpec above.
+	_ = writeReleasesCache(cacheFilePath, releases)
+	return releases, nil
+}
+
+func readReleasesCache(cacheFilePath string, ttl time.Duration) ([]githubRelease, bool) {
+	data, err := os.ReadFile(cacheFilePath)
+	if err != nil {
+		return nil, false
+	}
+	var cache releasesCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, false
+	}
+	if time.Since(cache.FetchedAt) > ttl {
+		return nil, false
+	}
+	return cache.Releases, true
+}
+
+func writeReleasesCache(cacheFilePath string, releases []githubRelease) error {
+	data, err := json.Marshal(releasesCache{
+		FetchedAt: time.Now().UTC(),
+		Releases:  releases,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cacheFilePath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(cacheFilePath, data, 0600)
+}
+
+// fetchBufReleases fetches every page of the GitHub releases listing for
+// bufbuild/buf. The API defaults to 30 releases per page, which - left
+// unpaginated - would silently limit version resolution to only the most
+// recent releases, making an older-but-still-matching version range resolve
+// to "no buf release matching" as if it genuinely didn't exist.
+func fetchBufReleases(ctx context.Context) ([]githubRelease, error) {
+	var allReleases []githubRelease
+	for page := 1; page <= githubReleasesMaxPages; page++ {
+		url := fmt.Sprintf("%s?per_page=%d&page=%d", githubBufReleasesURL, githubReleasesPerPage, page)
+		data, err := downloadData(ctx, url)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch buf releases: %w", err)
+		}
+		var releases []githubRelease
+		if err := json.Unmarshal(data, &releases); err != nil {
+			return nil, fmt.Errorf("could not parse buf releases: %w", err)
+		}
+		allReleases = append(allReleases, releases...)
+		if len(releases) < githubReleasesPerPage {
+			break
+		}
+	}
+	return allReleases, nil
+}
+
+// bufReleaseCandidate pairs a parsed semver with the release it came from.
+//
+// fullVersion is the full MAJOR.MINOR.PATCH[-PRERELEASE] text (without the
+// "v"), used to build download URLs and cache keys - version is parsed from
+// just the MAJOR.MINOR.PATCH prefix, and exists only for sorting and range
+// matching.
+type bufReleaseCandidate struct {
+	version     semver
+	fullVersion string
+	prerelease  bool
+}
+
+// selectBufVersion resolves bufVersionSpec - a channel or a semver range -
+// against releases, returning the highest matching concrete version.
+func selectBufVersion(bufVersionSpec string, releases []githubRelease) (string, error) {
+	candidates := make([]bufReleaseCandidate, 0, len(releases))
+	for _, release := range releases {
+		version, fullVersion, err := parseBufReleaseTag(release.TagName)
+		if err != nil {
+			// Skip tags that are not buf releases we recognize, e.g. tooling tags.
+			continue
+		}
+		candidates = append(candidates, bufReleaseCandidate{
+			version:     version,
+			fullVersion: fullVersion,
+			prerelease:  release.Prerelease,
+		})
+	}
+	sortBufReleaseCandidatesDescending(candidates)
+	switch bufVersionSpec {
+	case bufVersionChannelLatest:
+		for _, candidate := range candidates {
+			if !candidate.prerelease {
+				return candidate.fullVersion, nil
+			}
+		}
+		return "", fmt.Errorf("no stable buf release found for channel %q", bufVersionSpec)
+	case bufVersionChannelLatestRC:
+		for _, candidate := range candidates {
+			if candidate.prerelease {
+				return candidate.fullVersion, nil
+			}
+		}
+		return "", fmt.Errorf("no prerelease buf release found for channel %q", bufVersionSpec)
+	default:
+		matches, err := parseVersionRange(bufVersionSpec)
+		if err != nil {
+			return "", err
+		}
+		for _, candidate := range candidates {
+			if !candidate.prerelease && matches(candidate.version) {
+				return candidate.fullVersion, nil
+			}
+		}
+		return "", fmt.Errorf("no buf release matching %q found", bufVersionSpec)
+	}
+}
+
+func sortBufReleaseCandidatesDescending(candidates []bufReleaseCandidate) {
+	for i := 1; i < len(candidates); i++ {
+		for j := i; j > 0 && semverLess(candidates[j-1].version, candidates[j].version); j-- {
+			candidates[j-1], candidates[j] = candidates[j], candidates[j-1]
+		}
+	}
+}
+
+// parseBufReleaseTag parses a GitHub release tag, e.g. "v1.32.0" or
+// "v1.33.0-rc1", into its semver and the full MAJOR.MINOR.PATCH[-PRERELEASE]
+// text bufisk uses elsewhere (without the "v"). The full text must be kept
+// intact, not truncated to MAJOR.MINOR.PATCH: it is what we feed back into
+// getFileURL to download the release, and a prerelease tag has no
+// MAJOR.MINOR.PATCH release of its own to fall back to. The release's
+// Prerelease field, not the tag text, is what we trust for channel
+// filtering.
+func parseBufReleaseTag(tagName string) (semver, string, error) {
+	fullVersion := strings.TrimPrefix(tagName, "v")
+	numericVersion := fullVersion
+	if idx := strings.IndexAny(numericVersion, "-+"); idx >= 0 {
+		numericVersion = numericVersion[:idx]
+	}
+	version, err := parsePartialSemver(numericVersion)
+	if err != nil {
+		return semver{}, "", err
+	}
+	return version, fullVersion, nil
+}
+
+// semver is a parsed MAJOR.MINOR.PATCH.
+type semver struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func semverLess(a semver, b semver) bool {
+	if a.Major != b.Major {
+		return a.Major < b.Major
+	}
+	if a.Minor != b.Minor {
+		return a.Minor < b.Minor
+	}
+	return a.Patch < b.Patch
+}
+
+// parsePartialSemver parses "1", "1.30", or "1.30.2", defaulting missing
+// components to 0.
+func parsePartialSemver(s string) (semver, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return semver{}, fmt.Errorf("invalid version %q", s)
+	}
+	var components [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return semver{}, fmt.Errorf("invalid version %q: %w", s, err)
+		}
+		components[i] = n
+	}
+	return semver{Major: components[0], Minor: components[1], Patch: components[2]}, nil
+}
+
+// parseVersionRange parses a whitespace-separated list of comparator
+// constraints - caret ("^1.30"), tilde ("~1.30.2"), and the usual relational
+// operators ("<2", ">=1.29 <2") - into a single predicate that is the
+// conjunction of all of them.
+func parseVersionRange(bufVersionSpec string) (func(semver) bool, error) {
+	tokens := strings.Fields(bufVersionSpec)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty version range")
+	}
+	predicates := make([]func(semver) bool, 0, len(tokens))
+	for _, token := range tokens {
+		predicate, err := parseVersionRangeToken(token)
+		if err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, predicate)
+	}
+	return func(version semver) bool {
+		for _, predicate := range predicates {
+			if !predicate(version) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func parseVersionRangeToken(token string) (func(semver) bool, error) {
+	switch {
+	case strings.HasPrefix(token, "^"):
+		base, err := parsePartialSemver(token[1:])
+		if err != nil {
+			return nil, err
+		}
+		upper := semver{Major: base.Major + 1}
+		return func(v semver) bool { return !semverLess(v, base) && semverLess(v, upper) }, nil
+	case strings.HasPrefix(token, "~"):
+		base, err := parsePartialSemver(token[1:])
+		if err != nil {
+			return nil, err
+		}
+		upper := semver{Major: base.Major, Minor: base.Minor + 1}
+		return func(v semver) bool { return !semverLess(v, base) && semverLess(v, upper) }, nil
+	case strings.HasPrefix(token, ">="):
+		base, err := parsePartialSemver(token[2:])
+		if err != nil {
+			return nil, err
+		}
+		return func(v semver) bool { return !semverLess(v, base) }, nil
+	case strings.HasPrefix(token, "<="):
+		base, err := parsePartialSemver(token[2:])
+		if err != nil {
+			return nil, err
+		}
+		return func(v semver) bool { return !semverLess(base, v) }, nil
+	case strings.HasPrefix(token, ">"):
+		base, err := parsePartialSemver(token[1:])
+		if err != nil {
+			return nil, err
+		}
+		return func(v semver) bool { return semverLess(base, v) }, nil
+	case strings.HasPrefix(token, "<"):
+		base, err := parsePartialSemver(token[1:])
+		if err != nil {
+			return nil, err
+		}
+		return func(v semver) bool { return semverLess(v, base) }, nil
+	default:
+		return nil, fmt.Errorf("unsupported version range operator in %q", token)
+	}
+}